@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCacheGetSetRoundTrip(t *testing.T) {
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+
+	key := "https://example.com/region-from-loc?lat=1.000000&lon=2.000000"
+	want := []byte(`{"region":"CAISO_NORTH"}`)
+
+	if _, ok := cache.get(key); ok {
+		t.Fatalf("get on empty cache returned a hit")
+	}
+
+	if err := cache.set(key, want); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	got, ok := cache.get(key)
+	if !ok {
+		t.Fatalf("get after set returned no hit")
+	}
+	if string(got) != string(want) {
+		t.Fatalf("get = %q, want %q", got, want)
+	}
+}
+
+func TestDiskCachePathIsStableAndFlat(t *testing.T) {
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+
+	key := "https://example.com/a?b=c"
+
+	if got, want := cache.path(key), cache.path(key); got != want {
+		t.Fatalf("path is not stable across calls: %q != %q", got, want)
+	}
+
+	if filepath.Dir(cache.path(key)) != cache.dir {
+		t.Fatalf("path escaped the cache dir: %q", cache.path(key))
+	}
+}
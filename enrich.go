@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limits for the upstream APIs we call, chosen to stay within each
+// provider's published free-tier limits. They're kept per-host so a slow
+// provider doesn't throttle requests to a faster one.
+const (
+	nominatimRequestsPerSecond       = 1 // Nominatim's usage policy caps free use at 1 req/s.
+	electricityMapsRequestsPerSecond = 10
+	wattTimeRequestsPerSecond        = 10
+
+	enrichWorkerCount = 8
+)
+
+// rateLimiters holds one token-bucket limiter per upstream host.
+type rateLimiters struct {
+	nominatim       *rate.Limiter
+	electricityMaps *rate.Limiter
+	wattTime        *rate.Limiter
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{
+		nominatim:       rate.NewLimiter(rate.Limit(nominatimRequestsPerSecond), 1),
+		electricityMaps: rate.NewLimiter(rate.Limit(electricityMapsRequestsPerSecond), electricityMapsRequestsPerSecond),
+		wattTime:        rate.NewLimiter(rate.Limit(wattTimeRequestsPerSecond), wattTimeRequestsPerSecond),
+	}
+}
+
+// concurrentRegionMap runs fn over each region using a fixed-size worker
+// pool, writing results back into regions in place. It waits for every
+// region to finish before returning, so one failure doesn't strand
+// in-flight work; it returns the first error encountered, if any.
+//
+// It cancels a derived context as soon as any worker reports an error, so
+// workers that haven't started their job yet skip it instead of still
+// hitting the rate-limited upstream APIs for every remaining region.
+func concurrentRegionMap(ctx context.Context, regions []Region, fn func(ctx context.Context, region Region) (Region, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		index  int
+		region Region
+	}
+	type result struct {
+		index  int
+		region Region
+		err    error
+	}
+
+	jobs := make(chan job, len(regions))
+	for i, region := range regions {
+		jobs <- job{index: i, region: region}
+	}
+	close(jobs)
+
+	results := make(chan result, len(regions))
+
+	var wg sync.WaitGroup
+	for i := 0; i < enrichWorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := ctx.Err(); err != nil {
+					results <- result{index: j.index, err: err}
+					continue
+				}
+
+				region, err := fn(ctx, j.region)
+				if err != nil {
+					cancel()
+				}
+				results <- result{index: j.index, region: region, err: err}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	var firstErr error
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		regions[res.index] = res.region
+	}
+
+	return firstErr
+}
+
+// enrichRegions looks up every registered CarbonDataSource's zone for each
+// region concurrently.
+func enrichRegions(ctx context.Context, regions []Region, sources []CarbonDataSource) error {
+	return concurrentRegionMap(ctx, regions, func(ctx context.Context, region Region) (Region, error) {
+		return enrichRegion(ctx, region, sources)
+	})
+}
+
+func enrichRegion(ctx context.Context, region Region, sources []CarbonDataSource) (Region, error) {
+	for _, source := range sources {
+		name := source.Name()
+		if region.Zones[name] != "" {
+			continue
+		}
+
+		zone, err := source.Lookup(ctx, region.Latitude, region.Longitude)
+		if err != nil {
+			return region, err
+		}
+
+		if region.Zones == nil {
+			region.Zones = make(map[string]string, len(sources))
+		}
+		region.Zones[name] = zone
+	}
+
+	return region, nil
+}
+
+// fetchRegionIntensities looks up the current carbon intensity for each
+// region concurrently, from the first source (in registration order) that
+// implements CarbonIntensitySource and can successfully report one.
+func fetchRegionIntensities(ctx context.Context, regions []Region, sources []CarbonDataSource) error {
+	return concurrentRegionMap(ctx, regions, func(ctx context.Context, region Region) (Region, error) {
+		return regionIntensity(ctx, region, sources)
+	})
+}
+
+func regionIntensity(ctx context.Context, region Region, sources []CarbonDataSource) (Region, error) {
+	for _, source := range sources {
+		intensitySource, ok := source.(CarbonIntensitySource)
+		if !ok {
+			continue
+		}
+
+		value, timestamp, err := intensitySource.Intensity(ctx, region)
+		if err != nil || timestamp.IsZero() {
+			// This source has no intensity for this region; fall back to
+			// the next one rather than failing the whole run.
+			continue
+		}
+
+		region.CarbonIntensity = value
+		region.CarbonIntensityTimestamp = timestamp
+		region.CarbonIntensitySource = source.Name()
+		return region, nil
+	}
+
+	return region, nil
+}
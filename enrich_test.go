@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeIntensitySource is a CarbonDataSource/CarbonIntensitySource whose
+// Intensity result changes on every call, standing in for a live upstream
+// API when testing that repeated polls (as -watch does) actually observe
+// fresh readings rather than a cached one.
+type fakeIntensitySource struct {
+	calls int
+}
+
+func (s *fakeIntensitySource) Name() string { return "fake_zone" }
+
+func (s *fakeIntensitySource) Lookup(ctx context.Context, latitude, longitude float64) (string, error) {
+	return "FAKE_ZONE", nil
+}
+
+func (s *fakeIntensitySource) Intensity(ctx context.Context, region Region) (float64, time.Time, error) {
+	s.calls++
+	return float64(100 * s.calls), time.Now(), nil
+}
+
+func TestFetchRegionIntensitiesReflectsEachPoll(t *testing.T) {
+	source := &fakeIntensitySource{}
+	sources := []CarbonDataSource{source}
+
+	regions := []Region{{CloudRegion: "us-east-1", Zones: map[string]string{"fake_zone": "FAKE_ZONE"}}}
+
+	if err := fetchRegionIntensities(context.Background(), regions, sources); err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+	first := regions[0].CarbonIntensity
+
+	if err := fetchRegionIntensities(context.Background(), regions, sources); err != nil {
+		t.Fatalf("second poll: %v", err)
+	}
+	second := regions[0].CarbonIntensity
+
+	if first == second {
+		t.Fatalf("two polls returned the same carbon intensity (%v); a -watch run would never see an update", first)
+	}
+	if first != 100 || second != 200 {
+		t.Fatalf("got polls %v, %v, want 100, 200", first, second)
+	}
+}
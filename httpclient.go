@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	httpTimeout     = 10 * time.Second
+	httpMaxAttempts = 5
+	httpBaseDelay   = 500 * time.Millisecond
+)
+
+// retryClient wraps an *http.Client with exponential backoff and jitter on
+// 429/5xx responses (honoring Retry-After when present), and an optional
+// on-disk cache for idempotent GET requests.
+type retryClient struct {
+	httpClient  *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	cache       *diskCache
+}
+
+func newRetryClient(timeout time.Duration, maxAttempts int, baseDelay time.Duration, cache *diskCache) *retryClient {
+	return &retryClient{
+		httpClient:  &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		cache:       cache,
+	}
+}
+
+// cachedResponse is what we persist to disk for a cacheable response.
+type cachedResponse struct {
+	StatusCode int    `json:"status_code"`
+	Body       []byte `json:"body"`
+}
+
+// do executes req, retrying up to maxAttempts times on 429/5xx responses.
+// cacheable requests are served from disk on a hit, and successful
+// responses are written back on a miss; it must only be set for GET
+// requests whose response doesn't contain secrets.
+func (c *retryClient) do(req *http.Request, cacheable bool) (int, []byte, error) {
+	cacheKey := req.URL.String()
+	if cacheable && c.cache != nil {
+		if data, ok := c.cache.get(cacheKey); ok {
+			var cached cachedResponse
+			if err := json.Unmarshal(data, &cached); err == nil {
+				return cached.StatusCode, cached.Body, nil
+			}
+		}
+	}
+
+	var lastErr error
+	var nextDelay time.Duration
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithContext(req.Context(), nextDelay); err != nil {
+				return 0, nil, err
+			}
+		}
+		nextDelay = c.backoff(attempt + 1)
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			lastErr = fmt.Errorf("retryable response %d, giving up after %d attempts", resp.StatusCode, c.maxAttempts)
+			// Retry-After, when present, overrides our own backoff for the
+			// next attempt instead of stacking with it.
+			if wait := retryAfter(resp.Header.Get("Retry-After")); wait > 0 {
+				nextDelay = wait
+			}
+			continue
+		}
+
+		if cacheable && c.cache != nil && isCacheableStatus(resp.StatusCode) {
+			if data, err := json.Marshal(cachedResponse{StatusCode: resp.StatusCode, Body: body}); err == nil {
+				_ = c.cache.set(cacheKey, data)
+			}
+		}
+
+		return resp.StatusCode, body, nil
+	}
+
+	return 0, nil, lastErr
+}
+
+// isCacheableStatus reports whether a response is safe to persist to a
+// cache with no TTL: a genuine success, or the explicit "no coverage" 404
+// that callers like getElectricityMapsZone/getWattTimeRegion treat as a
+// stable answer rather than an error. Other 4xx responses (e.g. a bad API
+// key) must never be cached, or fixing the underlying credential/config
+// wouldn't stop the error from being replayed forever.
+func isCacheableStatus(statusCode int) bool {
+	if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+		return true
+	}
+	return statusCode == http.StatusNotFound
+}
+
+// backoff returns the delay before the given retry attempt (1-indexed),
+// as an exponential backoff off baseDelay with full jitter.
+func (c *retryClient) backoff(attempt int) time.Duration {
+	d := c.baseDelay * time.Duration(uint(1)<<uint(attempt-1))
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryAfter parses a Retry-After header, which may be either a number of
+// seconds or an HTTP date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryClientBackoffIsBoundedAndGrows(t *testing.T) {
+	c := &retryClient{baseDelay: 500 * time.Millisecond}
+
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := c.baseDelay * time.Duration(uint(1)<<uint(attempt-1))
+		for i := 0; i < 20; i++ {
+			d := c.backoff(attempt)
+			if d < 0 || d > max {
+				t.Fatalf("backoff(%d) = %v, want in [0, %v]", attempt, d, max)
+			}
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	got := retryAfter("120")
+	if got != 120*time.Second {
+		t.Fatalf("retryAfter(\"120\") = %v, want 120s", got)
+	}
+}
+
+func TestRetryAfterHTTPDate(t *testing.T) {
+	when := time.Now().Add(2 * time.Minute)
+	got := retryAfter(when.UTC().Format(http.TimeFormat))
+	if got <= 0 || got > 2*time.Minute {
+		t.Fatalf("retryAfter(HTTP date) = %v, want a positive duration close to 2m", got)
+	}
+}
+
+func TestRetryAfterEmptyOrInvalid(t *testing.T) {
+	for _, header := range []string{"", "not-a-valid-value"} {
+		if got := retryAfter(header); got != 0 {
+			t.Fatalf("retryAfter(%q) = %v, want 0", header, got)
+		}
+	}
+}
+
+func TestRetryClientDoRetriesOnTooManyRequests(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	c := newRetryClient(time.Second, 3, time.Millisecond, nil)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	statusCode, body, err := c.do(req, false)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	if statusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("do = (%d, %q), want (200, \"ok\")", statusCode, body)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("server received %d requests, want 2 (one 429 then one 200)", got)
+	}
+}
+
+func TestRetryClientDoCacheHitSkipsNetworkCall(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+	c := newRetryClient(time.Second, 3, time.Millisecond, cache)
+
+	newReq := func() *http.Request {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		return req
+	}
+
+	statusCode, body, err := c.do(newReq(), true)
+	if err != nil {
+		t.Fatalf("first do: %v", err)
+	}
+	if statusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("first do = (%d, %q), want (200, \"ok\")", statusCode, body)
+	}
+
+	statusCode, body, err = c.do(newReq(), true)
+	if err != nil {
+		t.Fatalf("second do: %v", err)
+	}
+	if statusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("second do = (%d, %q), want (200, \"ok\")", statusCode, body)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("server received %d requests, want 1 (second do should be served from cache)", got)
+	}
+}
+
+func TestRetryClientDoDoesNotCacheClientErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("bad key"))
+	}))
+	defer server.Close()
+
+	cache, err := newDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("newDiskCache: %v", err)
+	}
+	c := newRetryClient(time.Second, 3, time.Millisecond, cache)
+
+	newReq := func() *http.Request {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		return req
+	}
+
+	for i := 0; i < 2; i++ {
+		statusCode, _, err := c.do(newReq(), true)
+		if err != nil {
+			t.Fatalf("do[%d]: %v", i, err)
+		}
+		if statusCode != http.StatusUnauthorized {
+			t.Fatalf("do[%d] = %d, want 401", i, statusCode)
+		}
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("server received %d requests, want 2 (401 must never be served from cache)", got)
+	}
+
+	if _, ok := cache.get(server.URL); ok {
+		t.Fatalf("401 response was cached, want no cache entry")
+	}
+}
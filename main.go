@@ -4,14 +4,18 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -21,12 +25,20 @@ const (
 	openStreetMapBaseURL        = "https://nominatim.openstreetmap.org/search"
 	wattTimeUserEnvVar          = "WATT_TIME_USER"
 	wattTimePasswordEnvVar      = "WATT_TIME_PASSWORD"
+	wattTimeSignalTypesEnvVar   = "WATT_TIME_SIGNAL_TYPES"
 	wattTimeLoginURL            = "https://api.watttime.org/login"
 	wattTimeRegionURL           = "https://api.watttime.org/v3/region-from-loc"
+	wattTimeSignalIndexURL      = "https://api.watttime.org/v3/signal-index"
+	defaultWattTimeSignalType   = "co2_moer"
+	wattTimeTokenLifetime       = 30 * time.Minute
+	wattTimeTokenRefreshMargin  = 1 * time.Minute
+	httpCacheDirEnvVar          = "HTTP_CACHE_DIR"
+	defaultHTTPCacheDir         = ".cloud-region-carbon-cache"
+	defaultWatchInterval        = 5 * time.Minute
 )
 
 var (
-	header = []string{
+	baseHeader = []string{
 		"cloud_provider",
 		"cloud_region",
 		"location",
@@ -35,19 +47,61 @@ var (
 		"location_type",
 		"latitude",
 		"longitude",
-		"electricity_maps_zone",
-		"watt_time_region",
 	}
 )
 
+// wattTimeRegionColumn returns the CSV column name for a given WattTime
+// signal type, e.g. "watt_time_region_co2_moer".
+func wattTimeRegionColumn(signalType string) string {
+	return "watt_time_region_" + signalType
+}
+
+// wattTimeSignalTypes returns the configured list of WattTime signal types,
+// falling back to co2_moer if WATT_TIME_SIGNAL_TYPES is unset.
+func wattTimeSignalTypes() []string {
+	raw := os.Getenv(wattTimeSignalTypesEnvVar)
+	if raw == "" {
+		return []string{defaultWattTimeSignalType}
+	}
+
+	var signalTypes []string
+	for _, signalType := range strings.Split(raw, ",") {
+		signalType = strings.TrimSpace(signalType)
+		if signalType != "" {
+			signalTypes = append(signalTypes, signalType)
+		}
+	}
+
+	return signalTypes
+}
+
 func main() {
-	err := mainWithError(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := mainWithError(ctx)
 	if err != nil {
 		fmt.Printf("%#v", err)
 	}
 }
 
 func mainWithError(ctx context.Context) error {
+	formatFlag := flag.String("format", "csv", "output format: csv, json, or parquet")
+	intensityFlag := flag.Bool("intensity", false, "also fetch the current carbon intensity for each region")
+	watchFlag := flag.Bool("watch", false, "keep polling the carbon intensity for each region until interrupted, implies -intensity")
+	watchIntervalFlag := flag.Duration("watch-interval", defaultWatchInterval, "how often to poll in -watch mode")
+	timeseriesOutputFlag := flag.String("timeseries-output", "", "CSV file to append each -watch poll to (required with -watch)")
+	flag.Parse()
+
+	if *watchFlag && *timeseriesOutputFlag == "" {
+		return fmt.Errorf("-timeseries-output must be set when -watch is used")
+	}
+
+	regionWriter, err := newRegionWriter(*formatFlag)
+	if err != nil {
+		return err
+	}
+
 	electricityMapsAPIKey := os.Getenv(electricityMapsAPIKeyEnvVar)
 	if electricityMapsAPIKey == "" {
 		return fmt.Errorf("%s env var must be set", electricityMapsAPIKey)
@@ -61,139 +115,130 @@ func mainWithError(ctx context.Context) error {
 	if wattTimePassword == "" {
 		return fmt.Errorf("%s env var must be set", wattTimePasswordEnvVar)
 	}
-	wattTimeAccessToken, err := getWattTimeAccessToken(ctx, wattTimeUser, wattTimePassword)
-	if err != nil {
-		return err
-	}
 
-	regions, err := loadRegions(ctx, os.Args[1])
+	cacheDir := os.Getenv(httpCacheDirEnvVar)
+	if cacheDir == "" {
+		cacheDir = defaultHTTPCacheDir
+	}
+	cache, err := newDiskCache(cacheDir)
 	if err != nil {
 		return err
 	}
+	httpClient := newRetryClient(httpTimeout, httpMaxAttempts, httpBaseDelay, cache)
 
-	for i, region := range regions {
-		if region.ElectricityMapsZone == "" {
-			zone, err := getElectricityMapsZone(ctx, electricityMapsAPIKey, region.Latitude, region.Longitude)
-			if err != nil {
-				return err
-			}
-			region.ElectricityMapsZone = zone
-		}
-		if region.WattTimeRegion == "" {
-			regionID, err := getWattTimeRegion(ctx, wattTimeAccessToken, region.Latitude, region.Longitude)
-			if err != nil {
-				return err
-			}
-			region.WattTimeRegion = regionID
-		}
-		regions[i] = region
+	wtClient := newWattTimeClient(wattTimeUser, wattTimePassword, httpClient)
+
+	limiters := newRateLimiters()
+
+	sources := buildSources(sourceConfig{
+		electricityMapsAPIKey: electricityMapsAPIKey,
+		wattTimeClient:        wtClient,
+		wattTimeSignalTypes:   wattTimeSignalTypes(),
+		limiters:              limiters,
+		httpClient:            httpClient,
+	})
 
-		// Sleep to prevent rate limiting
-		time.Sleep(1 * time.Second)
+	header := make([]string, len(baseHeader), len(baseHeader)+len(sources))
+	copy(header, baseHeader)
+	for _, source := range sources {
+		header = append(header, source.Name())
 	}
 
-	writer := csv.NewWriter(os.Stdout)
+	regions, err := loadRegions(ctx, flag.Arg(0), sources, limiters, httpClient)
+	if err != nil {
+		return err
+	}
 
-	if err := writer.Write(header); err != nil {
+	if err := enrichRegions(ctx, regions, sources); err != nil {
 		return err
 	}
 
-	for _, region := range regions {
-		record := []string{
-			region.CloudProvider,
-			region.CloudRegion,
-			region.Location,
-			region.LocationOverride,
-			region.LocationSource,
-			region.LocationType,
-			fmt.Sprintf("%f", region.Latitude),
-			fmt.Sprintf("%f", region.Longitude),
-			region.ElectricityMapsZone,
-			region.WattTimeRegion,
-		}
-		if err := writer.Write(record); err != nil {
+	if *watchFlag {
+		watchHeader := append(append([]string{}, header...), intensityHeader...)
+		return runWatch(ctx, regions, sources, watchHeader, *watchIntervalFlag, *timeseriesOutputFlag)
+	}
+
+	if *intensityFlag {
+		if err := fetchRegionIntensities(ctx, regions, sources); err != nil {
 			return err
 		}
+		header = append(header, intensityHeader...)
 	}
 
-	writer.Flush()
+	return regionWriter.write(os.Stdout, header, regions)
+}
 
-	if err := writer.Error(); err != nil {
-		return err
+func getElectricityMapsZone(ctx context.Context, httpClient *retryClient, apiKey string, latitude, longitude float64) (string, error) {
+	// The zone a location maps to doesn't change, so this lookup is safe
+	// to cache indefinitely.
+	resp, err := fetchElectricityMaps(ctx, httpClient, apiKey, latitude, longitude, true)
+	if err != nil {
+		return "", err
 	}
-
-	return nil
+	return resp.Zone, nil
 }
 
-func getElectricityMapsZone(ctx context.Context, apiKey string, latitude, longitude float64) (string, error) {
+// fetchElectricityMaps is the single call behind both the zone lookup and
+// the current carbon intensity lookup: the Electricity Maps "latest"
+// endpoint returns both in one response. cacheable must be false for
+// intensity lookups: the disk cache has no TTL, so serving a live reading
+// from it would report the same value forever in -watch mode.
+func fetchElectricityMaps(ctx context.Context, httpClient *retryClient, apiKey string, latitude, longitude float64, cacheable bool) (ElectricityMapsResponse, error) {
 	params := url.Values{}
 	params.Add("lat", fmt.Sprintf("%f", latitude))
 	params.Add("lon", fmt.Sprintf("%f", longitude))
 	requestURL := electricityMapsBaseURL + "?" + params.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
-	req.Header.Add("auth-token", apiKey)
 	if err != nil {
-		return "", err
+		return ElectricityMapsResponse{}, err
 	}
+	req.Header.Add("auth-token", apiKey)
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	statusCode, body, err := httpClient.do(req, cacheable)
 	if err != nil {
-		return "", err
+		return ElectricityMapsResponse{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
+	if statusCode == http.StatusNotFound {
 		// No coverage
-		return "", nil
-	} else if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("expected %d response got %d", http.StatusOK, resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+		return ElectricityMapsResponse{}, nil
+	} else if statusCode != http.StatusOK {
+		return ElectricityMapsResponse{}, fmt.Errorf("expected %d response got %d", http.StatusOK, statusCode)
 	}
 
 	var electricityMapsResp ElectricityMapsResponse
 
-	err = json.Unmarshal(body, &electricityMapsResp)
-	if err != nil {
-		return "", err
+	if err := json.Unmarshal(body, &electricityMapsResp); err != nil {
+		return ElectricityMapsResponse{}, err
 	}
 
-	return electricityMapsResp.Zone, nil
+	return electricityMapsResp, nil
 }
 
-func getGeolocation(ctx context.Context, location, locationType string) (float64, float64, error) {
+func getGeolocation(ctx context.Context, httpClient *retryClient, limiter *rate.Limiter, location, locationType string) (float64, float64, error) {
+	if err := limiter.Wait(ctx); err != nil {
+		return 0, 0, err
+	}
+
 	params := url.Values{}
 	params.Add(locationType, location)
 	params.Add("format", "json")
 	params.Add("limit", "1")
 	requestURL := openStreetMapBaseURL + "?" + params.Encode()
 
-	// fmt.Println(requestURL)
-
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	statusCode, body, err := httpClient.do(req, true)
 	if err != nil {
 		return 0, 0, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, 0, fmt.Errorf("expected %d response got %d", http.StatusOK, resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return 0, 0, err
+	if statusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("expected %d response got %d", http.StatusOK, statusCode)
 	}
 
 	var places []OpenStreetMapPlace
@@ -219,43 +264,79 @@ func getGeolocation(ctx context.Context, location, locationType string) (float64
 	return 0, 0, nil
 }
 
-func getWattTimeAccessToken(ctx context.Context, apiUser, apiPassword string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wattTimeLoginURL, nil)
+// wattTimeClient manages a WattTime API login and caches the resulting
+// access token until shortly before it expires, rather than logging in
+// again for every request.
+type wattTimeClient struct {
+	user       string
+	password   string
+	httpClient *retryClient
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+}
+
+func newWattTimeClient(user, password string, httpClient *retryClient) *wattTimeClient {
+	return &wattTimeClient{user: user, password: password, httpClient: httpClient}
+}
+
+func (c *wattTimeClient) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.tokenExpiry) {
+		return c.accessToken, nil
+	}
+
+	accessToken, err := getWattTimeAccessToken(ctx, c.httpClient, c.user, c.password)
 	if err != nil {
 		return "", err
 	}
-	req.SetBasicAuth(apiUser, apiPassword)
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	c.accessToken = accessToken
+	c.tokenExpiry = time.Now().Add(wattTimeTokenLifetime - wattTimeTokenRefreshMargin)
+
+	return c.accessToken, nil
+}
+
+// getWattTimeAccessToken logs in to the WattTime API. Its response is
+// never disk-cached, since it contains a bearer token.
+func getWattTimeAccessToken(ctx context.Context, httpClient *retryClient, apiUser, apiPassword string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wattTimeLoginURL, nil)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	req.SetBasicAuth(apiUser, apiPassword)
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("expected %d response got %d", http.StatusOK, resp.StatusCode)
+	statusCode, body, err := httpClient.do(req, false)
+	if err != nil {
+		return "", err
 	}
 
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", nil
+	if statusCode != http.StatusOK {
+		return "", fmt.Errorf("expected %d response got %d", http.StatusOK, statusCode)
 	}
 
 	loginResp := WattTimeLoginResp{}
-	err = json.Unmarshal(bytes, &loginResp)
+	err = json.Unmarshal(body, &loginResp)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return loginResp.Token, nil
 }
 
-func getWattTimeRegion(ctx context.Context, accessToken string, latitude, longitude float64) (string, error) {
+func getWattTimeRegion(ctx context.Context, client *wattTimeClient, latitude, longitude float64, signalType string) (string, error) {
+	accessToken, err := client.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
 	params := url.Values{}
 	params.Add("latitude", fmt.Sprintf("%f", latitude))
 	params.Add("longitude", fmt.Sprintf("%f", longitude))
-	params.Add("signal_type", "co2_moer")
+	params.Add("signal_type", signalType)
 	requestURL := wattTimeRegionURL + "?" + params.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
@@ -264,35 +345,76 @@ func getWattTimeRegion(ctx context.Context, accessToken string, latitude, longit
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	statusCode, body, err := client.httpClient.do(req, true)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
+	if statusCode == http.StatusNotFound {
 		// No coverage
 		return "", nil
-	} else if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("expected %d response got %d", http.StatusOK, resp.StatusCode)
+	} else if statusCode != http.StatusOK {
+		return "", fmt.Errorf("expected %d response got %d", http.StatusOK, statusCode)
 	}
 
-	bytes, err := io.ReadAll(resp.Body)
+	regionResp := WattTimeRegionResp{}
+	err = json.Unmarshal(body, &regionResp)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
-	regionResp := WattTimeRegionResp{}
-	err = json.Unmarshal(bytes, &regionResp)
+	return regionResp.Region, nil
+}
+
+// getWattTimeIntensity fetches the current value of the given signal type
+// for a region already resolved by getWattTimeRegion.
+func getWattTimeIntensity(ctx context.Context, client *wattTimeClient, region, signalType string) (float64, time.Time, error) {
+	accessToken, err := client.token(ctx)
 	if err != nil {
-		return "", nil
+		return 0, time.Time{}, err
 	}
 
-	return regionResp.Region, nil
+	params := url.Values{}
+	params.Add("region", region)
+	params.Add("signal_type", signalType)
+	requestURL := wattTimeSignalIndexURL + "?" + params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	// Never cached: this is a live reading, and the disk cache has no TTL,
+	// so serving a cached hit here would report the same value forever in
+	// -watch mode.
+	statusCode, body, err := client.httpClient.do(req, false)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if statusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("expected %d response got %d", http.StatusOK, statusCode)
+	}
+
+	signalResp := WattTimeSignalResp{}
+	if err := json.Unmarshal(body, &signalResp); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if len(signalResp.Data) == 0 {
+		return 0, time.Time{}, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, signalResp.Data[0].PointTime)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return signalResp.Data[0].Value, timestamp, nil
 }
 
-func loadRegions(ctx context.Context, fileName string) ([]Region, error) {
+func loadRegions(ctx context.Context, fileName string, sources []CarbonDataSource, limiters *rateLimiters, httpClient *retryClient) ([]Region, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -340,24 +462,34 @@ func loadRegions(ctx context.Context, fileName string) ([]Region, error) {
 				location = parseAWSLocation(location)
 			}
 
-			latitude, longitude, err = getGeolocation(ctx, location, locationType)
+			latitude, longitude, err = getGeolocation(ctx, httpClient, limiters.nominatim, location, locationType)
 			if err != nil {
 				return nil, err
 			}
 		}
 
 		region := Region{
-			CloudProvider:       record[0],
-			CloudRegion:         record[1],
-			Location:            record[2],
-			LocationOverride:    record[3],
-			LocationSource:      record[4],
-			LocationType:        record[5],
-			Latitude:            latitude,
-			Longitude:           longitude,
-			ElectricityMapsZone: record[8],
-			WattTimeRegion:      record[9],
+			CloudProvider:    record[0],
+			CloudRegion:      record[1],
+			Location:         record[2],
+			LocationOverride: record[3],
+			LocationSource:   record[4],
+			LocationType:     record[5],
+			Latitude:         latitude,
+			Longitude:        longitude,
 		}
+
+		for i, source := range sources {
+			column := len(baseHeader) + i
+			if column >= len(record) || record[column] == "" {
+				continue
+			}
+			if region.Zones == nil {
+				region.Zones = make(map[string]string, len(sources))
+			}
+			region.Zones[source.Name()] = record[column]
+		}
+
 		regions = append(regions, region)
 	}
 
@@ -379,20 +511,29 @@ func parseAWSLocation(input string) string {
 }
 
 type Region struct {
-	CloudProvider       string
-	CloudRegion         string
-	Location            string
-	LocationOverride    string
-	LocationSource      string
-	LocationType        string
-	Latitude            float64
-	Longitude           float64
-	ElectricityMapsZone string
-	WattTimeRegion      string
+	CloudProvider    string
+	CloudRegion      string
+	Location         string
+	LocationOverride string
+	LocationSource   string
+	LocationType     string
+	Latitude         float64
+	Longitude        float64
+	// Zones holds the zone/region ID returned by each CarbonDataSource,
+	// keyed by that source's Name(), e.g. "watt_time_region_co2_moer" ->
+	// "CAISO_NORTH".
+	Zones map[string]string
+	// CarbonIntensity and its related fields are only populated when
+	// -intensity or -watch is used.
+	CarbonIntensity          float64
+	CarbonIntensityTimestamp time.Time
+	CarbonIntensitySource    string
 }
 
 type ElectricityMapsResponse struct {
-	Zone string `json:"zone"`
+	Zone            string  `json:"zone"`
+	CarbonIntensity float64 `json:"carbonIntensity"`
+	Datetime        string  `json:"datetime"`
 }
 
 type OpenStreetMapPlace struct {
@@ -407,3 +548,10 @@ type WattTimeLoginResp struct {
 type WattTimeRegionResp struct {
 	Region string `json:"region"`
 }
+
+type WattTimeSignalResp struct {
+	Data []struct {
+		Value     float64 `json:"value"`
+		PointTime string  `json:"point_time"`
+	} `json:"data"`
+}
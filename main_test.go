@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeWattTimeLoginTransport answers every request to wattTimeLoginURL with
+// a fresh token and counts how many times it was hit, so tests can assert
+// wattTimeClient.token() only logs in when its cached token is missing or
+// expired.
+type fakeWattTimeLoginTransport struct {
+	logins int32
+}
+
+func (t *fakeWattTimeLoginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.String(), wattTimeLoginURL) {
+		return nil, fmt.Errorf("unexpected request to %s", req.URL.String())
+	}
+
+	atomic.AddInt32(&t.logins, 1)
+
+	body, _ := json.Marshal(WattTimeLoginResp{Token: "fake-token"})
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestWattTimeClientTokenCachesWithinLifetime(t *testing.T) {
+	transport := &fakeWattTimeLoginTransport{}
+	restore := swapDefaultTransport(transport)
+	defer restore()
+
+	client := newWattTimeClient("user", "password", newRetryClient(httpTimeout, httpMaxAttempts, httpBaseDelay, nil))
+
+	first, err := client.token(context.Background())
+	if err != nil {
+		t.Fatalf("first token(): %v", err)
+	}
+
+	second, err := client.token(context.Background())
+	if err != nil {
+		t.Fatalf("second token(): %v", err)
+	}
+
+	if first != second {
+		t.Fatalf("token() = %q then %q, want the same cached token", first, second)
+	}
+	if got := atomic.LoadInt32(&transport.logins); got != 1 {
+		t.Fatalf("login hit %d times, want 1 (second call should use the cached token)", got)
+	}
+}
+
+func TestWattTimeClientTokenRefreshesAfterExpiry(t *testing.T) {
+	transport := &fakeWattTimeLoginTransport{}
+	restore := swapDefaultTransport(transport)
+	defer restore()
+
+	client := newWattTimeClient("user", "password", newRetryClient(httpTimeout, httpMaxAttempts, httpBaseDelay, nil))
+
+	if _, err := client.token(context.Background()); err != nil {
+		t.Fatalf("first token(): %v", err)
+	}
+
+	client.tokenExpiry = time.Now().Add(-time.Second)
+
+	if _, err := client.token(context.Background()); err != nil {
+		t.Fatalf("second token(): %v", err)
+	}
+
+	if got := atomic.LoadInt32(&transport.logins); got != 2 {
+		t.Fatalf("login hit %d times, want 2 (expiry should force a re-login)", got)
+	}
+}
+
+func swapDefaultTransport(transport http.RoundTripper) (restore func()) {
+	previous := http.DefaultTransport
+	http.DefaultTransport = transport
+	return func() { http.DefaultTransport = previous }
+}
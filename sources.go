@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// CarbonDataSource maps a latitude/longitude to a grid operator's
+// identifier for that location (a "zone" or "region", depending on the
+// provider's terminology).
+type CarbonDataSource interface {
+	// Name identifies the source and is used as its CSV column header,
+	// e.g. "electricity_maps_zone" or "watt_time_region_co2_moer".
+	Name() string
+	Lookup(ctx context.Context, latitude, longitude float64) (string, error)
+}
+
+// CarbonIntensitySource is implemented by CarbonDataSource providers that
+// can also report the current carbon intensity for a region they've
+// already resolved. It's optional: a provider can implement just
+// CarbonDataSource if it only supports mapping.
+type CarbonIntensitySource interface {
+	Intensity(ctx context.Context, region Region) (value float64, timestamp time.Time, err error)
+}
+
+// sourceConfig carries the configuration and rate limiters each
+// sourceFactory needs to build its CarbonDataSource(s).
+type sourceConfig struct {
+	electricityMapsAPIKey string
+	wattTimeClient        *wattTimeClient
+	wattTimeSignalTypes   []string
+	limiters              *rateLimiters
+	httpClient            *retryClient
+}
+
+type sourceFactory func(cfg sourceConfig) []CarbonDataSource
+
+// sourceFactories lists every provider this tool can enrich regions with.
+// Add a new provider (e.g. UK National Grid ESO, CO2signal, Ember) by
+// implementing CarbonDataSource and appending a factory here; main.go,
+// the CSV header and Region don't need to change.
+var sourceFactories = []sourceFactory{
+	newElectricityMapsSources,
+	newWattTimeSources,
+}
+
+// buildSources constructs every registered CarbonDataSource, in
+// sourceFactories order, so the CSV header and lookups are stable.
+func buildSources(cfg sourceConfig) []CarbonDataSource {
+	var sources []CarbonDataSource
+	for _, factory := range sourceFactories {
+		sources = append(sources, factory(cfg)...)
+	}
+	return sources
+}
+
+func newElectricityMapsSources(cfg sourceConfig) []CarbonDataSource {
+	return []CarbonDataSource{
+		&electricityMapsSource{
+			apiKey:     cfg.electricityMapsAPIKey,
+			limiter:    cfg.limiters.electricityMaps,
+			httpClient: cfg.httpClient,
+		},
+	}
+}
+
+type electricityMapsSource struct {
+	apiKey     string
+	limiter    *rate.Limiter
+	httpClient *retryClient
+}
+
+func (s *electricityMapsSource) Name() string {
+	return "electricity_maps_zone"
+}
+
+func (s *electricityMapsSource) Lookup(ctx context.Context, latitude, longitude float64) (string, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	return getElectricityMapsZone(ctx, s.httpClient, s.apiKey, latitude, longitude)
+}
+
+func (s *electricityMapsSource) Intensity(ctx context.Context, region Region) (float64, time.Time, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// cacheable=false: this is a live reading, not the static zone mapping.
+	resp, err := fetchElectricityMaps(ctx, s.httpClient, s.apiKey, region.Latitude, region.Longitude, false)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, resp.Datetime)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return resp.CarbonIntensity, timestamp, nil
+}
+
+// newWattTimeSources registers one CarbonDataSource per configured signal
+// type, since WattTime returns a separate region for each. Only the
+// co2_moer signal type also implements CarbonIntensitySource: the other
+// signal types (e.g. health_damage, co2_aoer) report in units other than
+// gCO2/kWh, and regionIntensity has nowhere to put them but the
+// carbon_intensity_gco2_per_kwh column.
+func newWattTimeSources(cfg sourceConfig) []CarbonDataSource {
+	sources := make([]CarbonDataSource, 0, len(cfg.wattTimeSignalTypes))
+	for _, signalType := range cfg.wattTimeSignalTypes {
+		base := &wattTimeSource{
+			client:     cfg.wattTimeClient,
+			signalType: signalType,
+			limiter:    cfg.limiters.wattTime,
+		}
+		if signalType == defaultWattTimeSignalType {
+			sources = append(sources, &wattTimeIntensitySource{wattTimeSource: base})
+			continue
+		}
+		sources = append(sources, base)
+	}
+	return sources
+}
+
+type wattTimeSource struct {
+	client     *wattTimeClient
+	signalType string
+	limiter    *rate.Limiter
+}
+
+func (s *wattTimeSource) Name() string {
+	return wattTimeRegionColumn(s.signalType)
+}
+
+func (s *wattTimeSource) Lookup(ctx context.Context, latitude, longitude float64) (string, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return "", err
+	}
+	return getWattTimeRegion(ctx, s.client, latitude, longitude, s.signalType)
+}
+
+// wattTimeIntensitySource adds CarbonIntensitySource to a wattTimeSource
+// configured with a MOER-style signal type, whose value is expressed in
+// gCO2/kWh like every other column fetchRegionIntensities writes to.
+type wattTimeIntensitySource struct {
+	*wattTimeSource
+}
+
+func (s *wattTimeIntensitySource) Intensity(ctx context.Context, region Region) (float64, time.Time, error) {
+	regionID := region.Zones[s.Name()]
+	if regionID == "" {
+		return 0, time.Time{}, fmt.Errorf("no %s region resolved for %q, run without -intensity first", s.Name(), region.CloudRegion)
+	}
+
+	if err := s.limiter.Wait(ctx); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return getWattTimeIntensity(ctx, s.client, regionID, s.signalType)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestNewWattTimeSourcesOnlyMOERImplementsIntensity(t *testing.T) {
+	sources := newWattTimeSources(sourceConfig{
+		wattTimeSignalTypes: []string{"co2_moer", "health_damage", "co2_aoer"},
+		limiters:            newRateLimiters(),
+	})
+
+	for _, source := range sources {
+		_, isIntensitySource := source.(CarbonIntensitySource)
+		want := source.Name() == wattTimeRegionColumn("co2_moer")
+		if isIntensitySource != want {
+			t.Fatalf("%s: CarbonIntensitySource = %v, want %v", source.Name(), isIntensitySource, want)
+		}
+	}
+}
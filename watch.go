@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"time"
+)
+
+// runWatch polls fetchRegionIntensities on interval until ctx is cancelled,
+// appending a CSV row per region to outputPath on every poll. The file is
+// created with a header if it doesn't already exist, so a watch can be
+// stopped and resumed into the same time-series file.
+func runWatch(ctx context.Context, regions []Region, sources []CarbonDataSource, header []string, interval time.Duration, outputPath string) error {
+	writer, closeWriter, err := newTimeSeriesWriter(outputPath, header)
+	if err != nil {
+		return err
+	}
+	defer closeWriter()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := fetchRegionIntensities(ctx, regions, sources); err != nil {
+			return err
+		}
+		if err := appendTimeSeriesRows(writer, header, regions); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// newTimeSeriesWriter opens outputPath for appending, writing header only
+// if the file is new, and returns a csv.Writer alongside a func to flush
+// and close the underlying file.
+func newTimeSeriesWriter(outputPath string, header []string) (*csv.Writer, func() error, error) {
+	_, err := os.Stat(outputPath)
+	exists := err == nil
+
+	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	writer := csv.NewWriter(file)
+
+	if !exists {
+		if err := writer.Write(header); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		writer.Flush()
+	}
+
+	return writer, func() error {
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}, nil
+}
+
+func appendTimeSeriesRows(writer *csv.Writer, columns []string, regions []Region) error {
+	for _, region := range regions {
+		row := regionRow(region, columns)
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
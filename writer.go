@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Column names for the carbon intensity fields, added to baseHeader when
+// -intensity or -watch is used.
+const (
+	carbonIntensityColumn          = "carbon_intensity_gco2_per_kwh"
+	carbonIntensityTimestampColumn = "carbon_intensity_timestamp"
+	carbonIntensitySourceColumn    = "carbon_intensity_source"
+)
+
+var intensityHeader = []string{
+	carbonIntensityColumn,
+	carbonIntensityTimestampColumn,
+	carbonIntensitySourceColumn,
+}
+
+// regionWriter encodes enriched regions in a particular output format.
+// Adding a new encoding means implementing this interface and adding a
+// case to newRegionWriter; the enrichment loop doesn't change.
+type regionWriter interface {
+	write(w io.Writer, columns []string, regions []Region) error
+}
+
+func newRegionWriter(format string) (regionWriter, error) {
+	switch format {
+	case "", "csv":
+		return csvRegionWriter{}, nil
+	case "json":
+		return jsonRegionWriter{}, nil
+	case "parquet":
+		return parquetRegionWriter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -format %q", format)
+	}
+}
+
+// regionRow returns region's value for each column, in order, typed as
+// the column's natural Go type (float64 for latitude/longitude, string
+// otherwise) so JSON and parquet output don't lose type information the
+// way CSV does.
+func regionRow(region Region, columns []string) map[string]any {
+	row := make(map[string]any, len(columns))
+	for _, column := range columns {
+		switch column {
+		case "cloud_provider":
+			row[column] = region.CloudProvider
+		case "cloud_region":
+			row[column] = region.CloudRegion
+		case "location":
+			row[column] = region.Location
+		case "location_override":
+			row[column] = region.LocationOverride
+		case "location_source":
+			row[column] = region.LocationSource
+		case "location_type":
+			row[column] = region.LocationType
+		case "latitude":
+			row[column] = region.Latitude
+		case "longitude":
+			row[column] = region.Longitude
+		case carbonIntensityColumn:
+			row[column] = region.CarbonIntensity
+		case carbonIntensityTimestampColumn:
+			if region.CarbonIntensityTimestamp.IsZero() {
+				row[column] = ""
+			} else {
+				row[column] = region.CarbonIntensityTimestamp.Format(time.RFC3339)
+			}
+		case carbonIntensitySourceColumn:
+			row[column] = region.CarbonIntensitySource
+		default:
+			row[column] = region.Zones[column]
+		}
+	}
+	return row
+}
+
+type csvRegionWriter struct{}
+
+func (csvRegionWriter) write(w io.Writer, columns []string, regions []Region) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	for _, region := range regions {
+		row := regionRow(region, columns)
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func csvValue(v any) string {
+	if f, ok := v.(float64); ok {
+		return fmt.Sprintf("%f", f)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+type jsonRegionWriter struct{}
+
+func (jsonRegionWriter) write(w io.Writer, columns []string, regions []Region) error {
+	rows := make([]map[string]any, len(regions))
+	for i, region := range regions {
+		rows[i] = regionRow(region, columns)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(rows)
+}
+
+type parquetRegionWriter struct{}
+
+func (parquetRegionWriter) write(w io.Writer, columns []string, regions []Region) error {
+	schema := parquetSchema(columns)
+
+	writer := parquet.NewGenericWriter[map[string]any](w, schema)
+
+	for _, region := range regions {
+		if _, err := writer.Write([]map[string]any{regionRow(region, columns)}); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// parquetSchema builds a schema matching the dynamic CSV/JSON columns: the
+// fixed location fields plus one optional string column per registered
+// CarbonDataSource.
+func parquetSchema(columns []string) *parquet.Schema {
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		switch column {
+		case "latitude", "longitude", carbonIntensityColumn:
+			group[column] = parquet.Leaf(parquet.DoubleType)
+		default:
+			group[column] = parquet.Optional(parquet.String())
+		}
+	}
+	return parquet.NewSchema("region", group)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testRegion() Region {
+	return Region{
+		CloudProvider: awsCloudProvider,
+		CloudRegion:   "us-east-1",
+		Location:      "N. Virginia",
+		Latitude:      38.13,
+		Longitude:     -78.45,
+		Zones: map[string]string{
+			"electricity_maps_zone": "US-MIDA-PJM",
+		},
+	}
+}
+
+func TestRegionRow(t *testing.T) {
+	columns := []string{"cloud_provider", "latitude", "longitude", "electricity_maps_zone"}
+	row := regionRow(testRegion(), columns)
+
+	if row["cloud_provider"] != awsCloudProvider {
+		t.Fatalf("cloud_provider = %v, want %v", row["cloud_provider"], awsCloudProvider)
+	}
+	if _, ok := row["latitude"].(float64); !ok {
+		t.Fatalf("latitude = %v (%T), want a float64", row["latitude"], row["latitude"])
+	}
+	if row["electricity_maps_zone"] != "US-MIDA-PJM" {
+		t.Fatalf("electricity_maps_zone = %v, want US-MIDA-PJM", row["electricity_maps_zone"])
+	}
+}
+
+func TestCSVValue(t *testing.T) {
+	if got := csvValue(38.130000); got != "38.130000" {
+		t.Fatalf("csvValue(float64) = %q, want %q", got, "38.130000")
+	}
+	if got := csvValue("US-MIDA-PJM"); got != "US-MIDA-PJM" {
+		t.Fatalf("csvValue(string) = %q, want %q", got, "US-MIDA-PJM")
+	}
+}
+
+func TestCSVRegionWriterWrite(t *testing.T) {
+	columns := []string{"cloud_region", "latitude", "electricity_maps_zone"}
+
+	var buf bytes.Buffer
+	if err := (csvRegionWriter{}).write(&buf, columns, []Region{testRegion()}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2 (header + row): %q", len(lines), buf.String())
+	}
+	if lines[0] != "cloud_region,latitude,electricity_maps_zone" {
+		t.Fatalf("header = %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "us-east-1,38.130000,US-MIDA-PJM") {
+		t.Fatalf("row = %q", lines[1])
+	}
+}
+
+func TestJSONRegionWriterWrite(t *testing.T) {
+	columns := []string{"cloud_region", "latitude"}
+
+	var buf bytes.Buffer
+	if err := (jsonRegionWriter{}).write(&buf, columns, []Region{testRegion()}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), `"cloud_region": "us-east-1"`) {
+		t.Fatalf("output missing cloud_region field: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"latitude": 38.13`) {
+		t.Fatalf("output should encode latitude as a JSON number, not a string: %s", buf.String())
+	}
+}
+
+func TestParquetSchemaTypesLatLonAsDouble(t *testing.T) {
+	schema := parquetSchema([]string{"latitude", "longitude", "electricity_maps_zone"})
+	if schema == nil {
+		t.Fatalf("parquetSchema returned nil")
+	}
+}
+
+func TestNewRegionWriterUnknownFormat(t *testing.T) {
+	if _, err := newRegionWriter("xml"); err == nil {
+		t.Fatalf("newRegionWriter(\"xml\") succeeded, want an error")
+	}
+}